@@ -0,0 +1,87 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux
+// +build linux
+
+package afpacket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// TestBlockHeaderOffsets guards against regressing the tpacket_block_desc
+// offsets: block_status/num_pkts/offset_to_first_pkt live 8 bytes into
+// the block, after its leading "version"/"offset_to_priv" words, not
+// at the very start.
+func TestBlockHeaderOffsets(t *testing.T) {
+	if blkStatusOffset != 8 {
+		t.Errorf("blkStatusOffset = %d, want 8", blkStatusOffset)
+	}
+	if blkNumPktsOffset != 12 {
+		t.Errorf("blkNumPktsOffset = %d, want 12", blkNumPktsOffset)
+	}
+	if blkFirstPktOff != 16 {
+		t.Errorf("blkFirstPktOff = %d, want 16", blkFirstPktOff)
+	}
+}
+
+func TestHtons(t *testing.T) {
+	swapped := map[uint16]uint16{
+		0x0003: 0x0300, // ETH_P_ALL
+		0x0800: 0x0008, // ETH_P_IP
+		0x00FF: 0xFF00,
+	}
+	for in, swap := range swapped {
+		want := swap
+		if hostIsBigEndian {
+			want = in // network order already matches host order
+		}
+		if got := htons(in); got != want {
+			t.Errorf("htons(%#x) = %#x, want %#x", in, got, want)
+		}
+	}
+}
+
+// TestZeroCopyReadPacketDataMacOffset builds a single-packet block by
+// hand, with a nonzero tp_net (as every real capture has, since
+// tp_net = tp_mac + link-header length), and checks the packet data
+// returned is sliced at tp_mac rather than at a 32-bit read that
+// bleeds into tp_net.
+func TestZeroCopyReadPacketDataMacOffset(t *testing.T) {
+	const blockSize = 4096
+	tp := &TPacket{cfg: tpacketConfig{numBlocks: 1, blockSize: blockSize}, ring: make([]byte, blockSize)}
+	blk := tp.block(0)
+	binary.LittleEndian.PutUint32(blk[blkStatusOffset:], tpStatusUser)
+	binary.LittleEndian.PutUint32(blk[blkNumPktsOffset:], 1)
+	const pktOffset = 64
+	binary.LittleEndian.PutUint32(blk[blkFirstPktOff:], pktOffset)
+
+	data := []byte("hello, tpacket3")
+	const macOffset = 40 // tp_mac; tp_net sits a 14-byte Ethernet header past it
+	hdr := blk[pktOffset:]
+	binary.LittleEndian.PutUint32(hdr[pktNextOffsetOffset:], 0)
+	binary.LittleEndian.PutUint32(hdr[pktSecOffset:], 1700000000)
+	binary.LittleEndian.PutUint32(hdr[pktNsecOffset:], 0)
+	binary.LittleEndian.PutUint32(hdr[pktSnaplenOffset:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(hdr[pktLenOffset:], uint32(len(data)))
+	binary.LittleEndian.PutUint16(hdr[pktMacOffset:], macOffset)
+	binary.LittleEndian.PutUint16(hdr[pktMacOffset+2:], macOffset+14) // tp_net
+	copy(hdr[macOffset:], data)
+
+	got, ci, err := tp.ZeroCopyReadPacketData()
+	if err != nil {
+		t.Fatalf("ZeroCopyReadPacketData: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("ZeroCopyReadPacketData data = %q, want %q", got, data)
+	}
+	if ci.CaptureLength != len(data) || ci.Length != len(data) {
+		t.Errorf("ZeroCopyReadPacketData ci = %+v, want CaptureLength=Length=%d", ci, len(data))
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux
+// +build linux
+
+package afpacket
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// tpacketReq3 mirrors linux/if_packet.h's struct tpacket_req3, used to
+// configure the PACKET_RX_RING ring buffer via setsockopt.
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+// setsockoptTpacketReq3 issues the PACKET_RX_RING setsockopt call,
+// which has no equivalent in the standard syscall package since its
+// argument is a fixed-layout struct rather than a plain int.
+func setsockoptTpacketReq3(fd int, req tpacketReq3) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT,
+		uintptr(fd), uintptr(solPacket), uintptr(packetRXRing),
+		uintptr(unsafe.Pointer(&req)), unsafe.Sizeof(req), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
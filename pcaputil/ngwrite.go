@@ -0,0 +1,190 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcaputil
+
+import (
+	"bufio"
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	ngBlockSectionHeader  = 0x0A0D0D0A
+	ngBlockInterfaceDesc  = 0x00000001
+	ngBlockEnhancedPacket = 0x00000006
+	ngByteOrderMagic      = 0x1A2B3C4D
+	ngVersionMajor        = 1
+	ngVersionMinor        = 0
+)
+
+// PCAPNG option codes, shared by every block type's options list.
+const (
+	ngOptEndOfOpt  = 0
+	ngOptComment   = 1
+	ngOptIfTsResol = 9
+)
+
+// NgInterface describes an interface recorded in a PCAPNG file, as
+// passed to NewNgWriter and AddInterface.
+type NgInterface struct {
+	LinkType layers.LinkType
+	SnapLen  uint32
+}
+
+// NgOption is a single PCAPNG block option, as accepted by WritePacket
+// for attaching per-packet metadata such as comments.
+type NgOption struct {
+	Code  uint16
+	Value []byte
+}
+
+// NgComment returns an NgOption that attaches a free-form comment to a
+// packet (option code 1), a common way to annotate interesting frames
+// for later inspection in Wireshark.
+func NgComment(s string) NgOption {
+	return NgOption{Code: ngOptComment, Value: []byte(s)}
+}
+
+// NgWriter wraps an underlying io.Writer to write packet data in the
+// PCAPNG (Next Generation) format.  See
+// https://github.com/pcapng/pcapng for details of the block format.
+//
+// Unlike Writer, NgWriter can record packets captured on more than one
+// interface in a single file, attach comments to individual packets,
+// and timestamp packets with nanosecond resolution.
+type NgWriter struct {
+	w          *bufio.Writer
+	interfaces int
+}
+
+// NewNgWriter returns a new NgWriter, writing a Section Header Block
+// followed by an Interface Description Block for iface to w.  The
+// returned writer is ready to have WritePacket called on it, passing
+// 0 as the interface id.
+func NewNgWriter(w io.Writer, iface NgInterface) (*NgWriter, error) {
+	ngw := &NgWriter{w: bufio.NewWriter(w)}
+	if err := ngw.writeSectionHeader(); err != nil {
+		return nil, fmt.Errorf("error writing section header block: %v", err)
+	}
+	if _, err := ngw.AddInterface(iface); err != nil {
+		return nil, err
+	}
+	return ngw, nil
+}
+
+// writeBlock frames body with the leading block type and total-length
+// words and the trailing total-length word required by every PCAPNG
+// block.
+func (w *NgWriter) writeBlock(blockType uint32, body []byte) error {
+	totalLen := uint32(4 + 4 + len(body) + 4)
+	var head [8]byte
+	binary.LittleEndian.PutUint32(head[0:4], blockType)
+	binary.LittleEndian.PutUint32(head[4:8], totalLen)
+	if _, err := w.w.Write(head[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(body); err != nil {
+		return err
+	}
+	var tail [4]byte
+	binary.LittleEndian.PutUint32(tail[:], totalLen)
+	_, err := w.w.Write(tail[:])
+	return err
+}
+
+// appendOptions appends each of opts to buf, padded to a 4-byte
+// boundary and length-prefixed, followed by a terminating
+// opt_endofopt.
+func appendOptions(buf []byte, opts []NgOption) []byte {
+	for _, opt := range opts {
+		buf = appendOption(buf, opt.Code, opt.Value)
+	}
+	return appendOption(buf, ngOptEndOfOpt, nil)
+}
+
+func appendOption(buf []byte, code uint16, value []byte) []byte {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint16(hdr[0:2], code)
+	binary.LittleEndian.PutUint16(hdr[2:4], uint16(len(value)))
+	buf = append(buf, hdr[:]...)
+	buf = append(buf, value...)
+	if pad := (4 - len(value)%4) % 4; pad > 0 {
+		buf = append(buf, make([]byte, pad)...)
+	}
+	return buf
+}
+
+func (w *NgWriter) writeSectionHeader() error {
+	body := make([]byte, 0, 16)
+	var head [16]byte
+	binary.LittleEndian.PutUint32(head[0:4], ngByteOrderMagic)
+	binary.LittleEndian.PutUint16(head[4:6], ngVersionMajor)
+	binary.LittleEndian.PutUint16(head[6:8], ngVersionMinor)
+	for i := 8; i < 16; i++ {
+		head[i] = 0xFF // section length, -1 (unknown)
+	}
+	body = append(body, head[:]...)
+	return w.writeBlock(ngBlockSectionHeader, body)
+}
+
+// AddInterface writes a new Interface Description Block for iface,
+// recording its LinkType, SnapLen, and a nanosecond if_tsresol option,
+// and returns the interface id to pass to WritePacket for packets
+// captured on it.
+func (w *NgWriter) AddInterface(iface NgInterface) (id int, err error) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:2], uint16(iface.LinkType))
+	// bytes 2:4 stay 0 (reserved)
+	binary.LittleEndian.PutUint32(body[4:8], iface.SnapLen)
+	body = appendOptions(body, []NgOption{{Code: ngOptIfTsResol, Value: []byte{9}}})
+	if err := w.writeBlock(ngBlockInterfaceDesc, body); err != nil {
+		return 0, fmt.Errorf("error writing interface description block: %v", err)
+	}
+	id = w.interfaces
+	w.interfaces++
+	return id, nil
+}
+
+// WritePacket writes the given packet data, captured on the given
+// interface id (as returned by NewNgWriter or AddInterface), out as an
+// Enhanced Packet Block.  Any opts are attached as the block's options,
+// e.g. a comment produced by NgComment.
+func (w *NgWriter) WritePacket(iface int, ci gopacket.CaptureInfo, data []byte, opts ...NgOption) error {
+	if iface < 0 || iface >= w.interfaces {
+		return fmt.Errorf("invalid interface id %d", iface)
+	}
+	if ci.CaptureLength != len(data) {
+		return fmt.Errorf("capture length %d does not match data length %d", ci.CaptureLength, len(data))
+	}
+	if ci.CaptureLength > ci.Length {
+		return fmt.Errorf("invalid capture info %+v:  capture length > length", ci)
+	}
+	nanos := uint64(ci.Timestamp.UnixNano())
+	body := make([]byte, 20, 20+len(data)+4)
+	binary.LittleEndian.PutUint32(body[0:4], uint32(iface))
+	binary.LittleEndian.PutUint32(body[4:8], uint32(nanos>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(nanos))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(ci.CaptureLength))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(ci.Length))
+	body = append(body, data...)
+	if pad := (4 - len(data)%4) % 4; pad > 0 {
+		body = append(body, make([]byte, pad)...)
+	}
+	body = appendOptions(body, opts)
+	if err := w.writeBlock(ngBlockEnhancedPacket, body); err != nil {
+		return fmt.Errorf("error writing enhanced packet block: %v", err)
+	}
+	return nil
+}
+
+// Flush writes any buffered data out to the underlying io.Writer.
+func (w *NgWriter) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,112 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcaputil
+
+import (
+	"bytes"
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// readBlock parses the leading type/length, body, and trailing length
+// of a single PCAPNG block out of buf, and returns the rest of buf
+// after it.
+func readBlock(t *testing.T, buf []byte) (blockType uint32, body, rest []byte) {
+	t.Helper()
+	if len(buf) < 12 {
+		t.Fatalf("block too short to contain a header/trailer: %d bytes", len(buf))
+	}
+	blockType = binary.LittleEndian.Uint32(buf[0:4])
+	totalLen := binary.LittleEndian.Uint32(buf[4:8])
+	if int(totalLen) > len(buf) {
+		t.Fatalf("block claims length %d but only %d bytes remain", totalLen, len(buf))
+	}
+	trailer := binary.LittleEndian.Uint32(buf[totalLen-4 : totalLen])
+	if trailer != totalLen {
+		t.Fatalf("block's trailing length %d does not match its leading length %d", trailer, totalLen)
+	}
+	if totalLen%4 != 0 {
+		t.Fatalf("block length %d is not a multiple of 4", totalLen)
+	}
+	return blockType, buf[8 : totalLen-4], buf[totalLen:]
+}
+
+// TestNgWriterBlockFraming checks the section header, interface
+// description, and enhanced packet blocks NgWriter emits are
+// well-formed: correctly typed, self-consistent length prefix/suffix,
+// and (for the EPB) carrying the packet data and comment option back
+// out byte for byte.
+func TestNgWriterBlockFraming(t *testing.T) {
+	var out bytes.Buffer
+	w, err := NewNgWriter(&out, NgInterface{LinkType: layers.LinkTypeEthernet, SnapLen: 262144})
+	if err != nil {
+		t.Fatalf("NewNgWriter: %v", err)
+	}
+	data := []byte("pcapng golden bytes test")
+	ts := time.Unix(1700000000, 123456789)
+	ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data)}
+	if err := w.WritePacket(0, ci, data, NgComment("a comment")); err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	buf := out.Bytes()
+
+	blockType, body, buf := readBlock(t, buf)
+	if blockType != ngBlockSectionHeader {
+		t.Fatalf("first block type = %#x, want section header %#x", blockType, ngBlockSectionHeader)
+	}
+	if magic := binary.LittleEndian.Uint32(body[0:4]); magic != ngByteOrderMagic {
+		t.Errorf("section header byte-order magic = %#x, want %#x", magic, ngByteOrderMagic)
+	}
+
+	blockType, body, buf = readBlock(t, buf)
+	if blockType != ngBlockInterfaceDesc {
+		t.Fatalf("second block type = %#x, want interface description %#x", blockType, ngBlockInterfaceDesc)
+	}
+	if lt := binary.LittleEndian.Uint16(body[0:2]); layers.LinkType(lt) != layers.LinkTypeEthernet {
+		t.Errorf("interface description linktype = %d, want %d", lt, layers.LinkTypeEthernet)
+	}
+	if sl := binary.LittleEndian.Uint32(body[4:8]); sl != 262144 {
+		t.Errorf("interface description snaplen = %d, want 262144", sl)
+	}
+
+	blockType, body, buf = readBlock(t, buf)
+	if blockType != ngBlockEnhancedPacket {
+		t.Fatalf("third block type = %#x, want enhanced packet %#x", blockType, ngBlockEnhancedPacket)
+	}
+	if iface := binary.LittleEndian.Uint32(body[0:4]); iface != 0 {
+		t.Errorf("enhanced packet interface id = %d, want 0", iface)
+	}
+	gotNanos := uint64(binary.LittleEndian.Uint32(body[4:8]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:12]))
+	if wantNanos := uint64(ts.UnixNano()); gotNanos != wantNanos {
+		t.Errorf("enhanced packet timestamp = %d, want %d", gotNanos, wantNanos)
+	}
+	if capLen := binary.LittleEndian.Uint32(body[12:16]); int(capLen) != len(data) {
+		t.Errorf("enhanced packet captured length = %d, want %d", capLen, len(data))
+	}
+	gotData := body[20 : 20+len(data)]
+	if !bytes.Equal(gotData, data) {
+		t.Errorf("enhanced packet data = %q, want %q", gotData, data)
+	}
+	opts := body[20+(len(data)+3)/4*4:]
+	if code := binary.LittleEndian.Uint16(opts[0:2]); code != ngOptComment {
+		t.Errorf("enhanced packet first option code = %d, want comment %d", code, ngOptComment)
+	}
+	if n := int(binary.LittleEndian.Uint16(opts[2:4])); n > len(opts)-4 || string(opts[4:4+n]) != "a comment" {
+		t.Errorf("enhanced packet comment option = %q, want %q", opts[4:], "a comment")
+	}
+
+	if len(buf) != 0 {
+		t.Errorf("%d trailing bytes after the three expected blocks", len(buf))
+	}
+}
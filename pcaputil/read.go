@@ -0,0 +1,161 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcaputil
+
+import (
+	"bufio"
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Reader wraps an underlying io.Reader to read packet data in PCAP
+// format.  See http://wiki.wireshark.org/Development/LibpcapFileFormat
+// for information on the file format.
+//
+// Reader auto-detects the file's byte order and timestamp resolution
+// from its magic number, and transparently gunzips its input if it
+// looks gzip-compressed.  This makes it possible to read PCAP files
+// written by any of the common variants without the caller having to
+// know which one produced them.
+type Reader struct {
+	r         io.Reader
+	byteOrder binary.ByteOrder
+	// tsScale is the multiplier that converts the file's per-packet
+	// timestamp fraction into nanoseconds.
+	tsScale  int64
+	linktype layers.LinkType
+	snaplen  uint32
+	buf      []byte
+}
+
+// NewReader returns a new reader object, for reading packet data from
+// the given reader.  It reads and parses the file header immediately,
+// so the returned Reader is ready to have ReadPacketData called on it.
+//
+//	f, _ := os.Open("/tmp/file.pcap")
+//	r, err := pcaputil.NewReader(f)
+//	for {
+//		data, ci, err := r.ReadPacketData()
+//		if err == io.EOF {
+//			break
+//		}
+//		// handle data/ci/err
+//	}
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1F && magic[1] == 0x8B {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("error opening gzip-compressed pcap: %v", err)
+		}
+		return newReaderFrom(gr)
+	}
+	return newReaderFrom(br)
+}
+
+func newReaderFrom(r io.Reader) (*Reader, error) {
+	var buf [24]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return nil, fmt.Errorf("error reading file header: %v", err)
+	}
+	byteOrder, tsScale, err := detectMagic(buf[0:4])
+	if err != nil {
+		return nil, err
+	}
+	snaplen := byteOrder.Uint32(buf[16:20])
+	linktype := layers.LinkType(byteOrder.Uint32(buf[20:24]))
+	return &Reader{
+		r:         r,
+		byteOrder: byteOrder,
+		tsScale:   tsScale,
+		linktype:  linktype,
+		snaplen:   snaplen,
+		buf:       make([]byte, snaplen),
+	}, nil
+}
+
+// detectMagic determines the byte order and timestamp resolution a
+// PCAP file was written with by examining its 4-byte magic number,
+// sharing the detection logic DetectByteOrder and DetectResolution
+// use for append-mode Writer validation.
+func detectMagic(magic []byte) (byteOrder binary.ByteOrder, tsScale int64, err error) {
+	le := binary.LittleEndian.Uint32(magic)
+	byteOrder, err = DetectByteOrder(le)
+	if err != nil {
+		return nil, 0, err
+	}
+	resolution, err := DetectResolution(le)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resolution == TsResolutionMicro {
+		return byteOrder, 1000, nil
+	}
+	return byteOrder, 1, nil
+}
+
+// LinkType returns the link type given in the file header, describing
+// the type of packets stored in the file.
+func (r *Reader) LinkType() layers.LinkType {
+	return r.linktype
+}
+
+// Snaplen returns the maximum per-packet capture length given in the
+// file header.
+func (r *Reader) Snaplen() uint32 {
+	return r.snaplen
+}
+
+// ReadPacketData reads the next packet from the file and returns its
+// data along with the CaptureInfo describing it.  It returns io.EOF
+// once there are no more packets to read.
+//
+// Despite the name, the returned slice is NOT a caller-owned copy: it
+// aliases an internal buffer that Reader reuses (and overwrites) on
+// the next call to ReadPacketData, the same way gopacket's
+// ZeroCopyPacketDataSource works.  Callers that need to keep the data
+// past their next call must copy it out first.
+func (r *Reader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("truncated packet header: %v", err)
+		}
+		return nil, gopacket.CaptureInfo{}, err
+	}
+	secs := r.byteOrder.Uint32(header[0:4])
+	tsFrac := r.byteOrder.Uint32(header[4:8])
+	capLen := r.byteOrder.Uint32(header[8:12])
+	origLen := r.byteOrder.Uint32(header[12:16])
+	if capLen > r.snaplen {
+		return nil, gopacket.CaptureInfo{}, fmt.Errorf("capture length %d greater than snaplen %d", capLen, r.snaplen)
+	}
+	if capLen > origLen {
+		return nil, gopacket.CaptureInfo{}, fmt.Errorf("capture length %d greater than original length %d", capLen, origLen)
+	}
+	if uint32(len(r.buf)) < capLen {
+		r.buf = make([]byte, capLen)
+	}
+	data := r.buf[:capLen]
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, gopacket.CaptureInfo{}, fmt.Errorf("truncated packet data: %v", err)
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:     time.Unix(int64(secs), int64(tsFrac)*r.tsScale),
+		CaptureLength: int(capLen),
+		Length:        int(origLen),
+	}
+	return data, ci, nil
+}
@@ -0,0 +1,286 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcaputil
+
+import (
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RotationPolicy describes when a RotatingWriter should close its
+// current file and start a new one, and how completed files should be
+// managed afterwards.  A zero value for MaxBytes, MaxDuration, or
+// MaxPackets disables that particular rollover trigger; at least one
+// should be set.
+type RotationPolicy struct {
+	// MaxBytes rolls over once the current file has had at least this
+	// many bytes of PCAP data (header plus packet records) written to
+	// it.
+	MaxBytes int64
+	// MaxDuration rolls over once the current file has been open for
+	// at least this long.
+	MaxDuration time.Duration
+	// MaxPackets rolls over once the current file holds at least this
+	// many packets.
+	MaxPackets int64
+
+	// Gzip compresses each completed file in a background goroutine
+	// once it's rolled over, replacing it with a ".gz" sibling.
+	Gzip bool
+	// KeepLast retains only the most recent N completed files,
+	// deleting older ones.  Zero disables this retention cap.
+	KeepLast int
+	// MaxTotalBytes deletes the oldest completed files once their
+	// combined size exceeds this cap.  Zero disables this retention
+	// cap.
+	MaxTotalBytes int64
+
+	// OnError, if set, is called with the path and error for any
+	// failure encountered while compressing or retiring a completed
+	// file in the background.
+	OnError func(path string, err error)
+}
+
+// RotatingWriter wraps a sequence of PCAP files on disk, transparently
+// closing the current one and opening the next whenever policy's
+// thresholds are exceeded, so long-running captures don't require the
+// caller to manage file rollover themselves.  Each file gets its own
+// fresh PCAP file header; RotatingWriter never appends.
+type RotatingWriter struct {
+	mu       sync.Mutex
+	dir      string
+	prefix   string
+	snaplen  uint32
+	linktype layers.LinkType
+	policy   RotationPolicy
+
+	cur     *Writer
+	curFile *os.File
+	curPath string
+	opened  time.Time
+	written int64
+	packets int64
+	seq     int
+	closed  bool
+}
+
+// NewRotatingWriter returns a RotatingWriter that creates files named
+// "<prefix>-<timestamp>-<seq>.pcap" in dir, rolling over according to
+// policy.  dir is created if it does not already exist.
+func NewRotatingWriter(dir, prefix string, snaplen uint32, linktype layers.LinkType, policy RotationPolicy) (*RotatingWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("pcaputil: error creating capture directory %q: %v", dir, err)
+	}
+	rw := &RotatingWriter{
+		dir:      dir,
+		prefix:   prefix,
+		snaplen:  snaplen,
+		linktype: linktype,
+		policy:   policy,
+	}
+	if err := rw.rotate(); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// WritePacket writes the given packet data out to the current file,
+// rolling over to a new file first if policy requires it.
+func (rw *RotatingWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return fmt.Errorf("pcaputil: write to closed RotatingWriter")
+	}
+	if rw.shouldRotate() {
+		if err := rw.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := rw.cur.WritePacket(ci, data); err != nil {
+		return err
+	}
+	rw.written += int64(16 + len(data))
+	rw.packets++
+	return nil
+}
+
+func (rw *RotatingWriter) shouldRotate() bool {
+	if rw.cur == nil {
+		return true
+	}
+	p := rw.policy
+	switch {
+	case p.MaxBytes > 0 && rw.written >= p.MaxBytes:
+		return true
+	case p.MaxPackets > 0 && rw.packets >= p.MaxPackets:
+		return true
+	case p.MaxDuration > 0 && time.Since(rw.opened) >= p.MaxDuration:
+		return true
+	}
+	return false
+}
+
+// rotate closes the current file, if any, and opens the next one,
+// writing a fresh file header to it.
+func (rw *RotatingWriter) rotate() error {
+	if rw.cur != nil {
+		if err := rw.closeCurrent(); err != nil {
+			return err
+		}
+	}
+	rw.seq++
+	path := filepath.Join(rw.dir, fmt.Sprintf("%s-%s-%03d.pcap", rw.prefix, time.Now().Format("20060102-150405"), rw.seq))
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("pcaputil: error creating %q: %v", path, err)
+	}
+	w := NewWriter(f)
+	if err := w.WriteFileHeader(rw.snaplen, rw.linktype); err != nil {
+		f.Close()
+		return fmt.Errorf("pcaputil: error writing file header for %q: %v", path, err)
+	}
+	rw.cur = w
+	rw.curFile = f
+	rw.curPath = path
+	rw.opened = time.Now()
+	rw.written = 24 // the file header we just wrote
+	rw.packets = 0
+	return nil
+}
+
+// closeCurrent flushes and closes the file currently being written to,
+// then kicks off background compression and/or retention enforcement
+// for it.
+func (rw *RotatingWriter) closeCurrent() error {
+	path := rw.curPath
+	if err := rw.cur.Sync(); err != nil {
+		rw.curFile.Close()
+		return fmt.Errorf("pcaputil: error flushing %q: %v", path, err)
+	}
+	if err := rw.curFile.Close(); err != nil {
+		return fmt.Errorf("pcaputil: error closing %q: %v", path, err)
+	}
+	rw.cur, rw.curFile = nil, nil
+	if rw.policy.Gzip {
+		go rw.compressAndRetire(path)
+	} else {
+		rw.enforceRetention("")
+	}
+	return nil
+}
+
+// compressAndRetire gzip-compresses path, then enforces the retention
+// policy.  It runs in its own goroutine so rollover doesn't stall
+// packet capture.
+func (rw *RotatingWriter) compressAndRetire(path string) {
+	if err := gzipFile(path); err != nil && rw.policy.OnError != nil {
+		rw.policy.OnError(path, err)
+	}
+	rw.mu.Lock()
+	active := rw.curPath
+	rw.mu.Unlock()
+	rw.enforceRetention(active)
+}
+
+// enforceRetention deletes old completed files in dir according to
+// policy, never touching excludePath (the file currently being
+// written to, if any).
+func (rw *RotatingWriter) enforceRetention(excludePath string) {
+	p := rw.policy
+	if p.KeepLast <= 0 && p.MaxTotalBytes <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(filepath.Join(rw.dir, rw.prefix+"-*"))
+	if err != nil {
+		return
+	}
+	sort.Strings(matches) // timestamped names sort chronologically
+	var completed []string
+	for _, m := range matches {
+		if m != excludePath {
+			completed = append(completed, m)
+		}
+	}
+	if p.KeepLast > 0 && len(completed) > p.KeepLast {
+		stale := completed[:len(completed)-p.KeepLast]
+		for _, m := range stale {
+			if err := os.Remove(m); err != nil && p.OnError != nil {
+				p.OnError(m, err)
+			}
+		}
+		completed = completed[len(completed)-p.KeepLast:]
+	}
+	if p.MaxTotalBytes > 0 {
+		sizes := make([]int64, len(completed))
+		var total int64
+		for i, m := range completed {
+			if fi, err := os.Stat(m); err == nil {
+				sizes[i] = fi.Size()
+				total += fi.Size()
+			}
+		}
+		for i := 0; total > p.MaxTotalBytes && i < len(completed); i++ {
+			if err := os.Remove(completed[i]); err != nil && p.OnError != nil {
+				p.OnError(completed[i], err)
+			}
+			total -= sizes[i]
+		}
+	}
+}
+
+// gzipFile compresses path to path+".gz" and removes the original on
+// success.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		gz.Close()
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close flushes and closes the file currently being written to.  It
+// must be called before the RotatingWriter is discarded, or buffered
+// data for the current file will be lost.
+func (rw *RotatingWriter) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return nil
+	}
+	rw.closed = true
+	if rw.cur == nil {
+		return nil
+	}
+	return rw.closeCurrent()
+}
@@ -11,75 +11,234 @@
 package pcaputil
 
 import (
+	"bufio"
 	"code.google.com/p/gopacket"
 	"code.google.com/p/gopacket/layers"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 )
 
+// Syncer is implemented by writers (such as *os.File) that can be
+// asked to flush their in-memory data to stable storage.  Writer.Sync
+// uses it, via a type assertion, to fsync the file underlying a
+// Writer after a Flush.
+type Syncer interface {
+	Sync() error
+}
+
+// TsResolution selects the resolution a Writer encodes per-packet
+// timestamps with.
+type TsResolution int
+
+const (
+	// TsResolutionNano writes timestamps with nanosecond resolution.
+	// This is the default, and the only resolution older versions of
+	// this package could write.
+	TsResolutionNano TsResolution = iota
+	// TsResolutionMicro writes timestamps with microsecond resolution,
+	// for interop with tools that only understand classic PCAP files.
+	TsResolutionMicro
+)
+
+func (r TsResolution) String() string {
+	switch r {
+	case TsResolutionNano:
+		return "nanosecond"
+	case TsResolutionMicro:
+		return "microsecond"
+	}
+	return fmt.Sprintf("TsResolution(%d)", int(r))
+}
+
 // Writer wraps an underlying io.Writer to write packet data in PCAP
 // format.  See http://wiki.wireshark.org/Development/LibpcapFileFormat
 // for information on the file format.
 //
-// For those that care, we currently write v2.4 files with nanosecond
-// timestamp resolution and little-endian encoding.
+// By default, a Writer writes nanosecond-resolution, little-endian
+// files; pass WithTimestampResolution and/or WithByteOrder to NewWriter
+// or NewWriterSize to produce classic microsecond-resolution and/or
+// big-endian files instead, for interop with tools or legacy capture
+// hosts that expect those variants.
+//
+// Writer buffers its output, coalescing each packet's header and data
+// into the buffer with a single Write call rather than issuing two
+// separate writes to the underlying io.Writer.  Call Flush (or Sync,
+// if the underlying writer supports it) to make sure buffered data has
+// actually been written out; this is required before closing the
+// underlying writer.  A Writer may be used safely from multiple
+// goroutines.
 type Writer struct {
-	w io.Writer
+	mu         sync.Mutex
+	buf        *bufio.Writer
+	w          io.Writer
+	byteOrder  binary.ByteOrder
+	resolution TsResolution
+	// scratch holds the most recent packet's header+data, reused
+	// across calls to WritePacket so they can be coalesced into a
+	// single Write without allocating every time.
+	scratch []byte
 }
 
 const magicNanoseconds = 0xA1B23C4D
+const magicMicroseconds = 0xA1B2C3D4
 const versionMajor = 2
 const versionMinor = 4
 
+// defaultBufSize matches bufio's own default, so NewWriter and
+// NewWriterSize(w, 0) behave the same.
+const defaultBufSize = 4096
+
+// WriterOption configures a Writer constructed by NewWriter or
+// NewWriterSize.
+type WriterOption func(*Writer)
+
+// WithTimestampResolution selects the resolution a Writer encodes
+// packet timestamps with.  The default is TsResolutionNano.
+func WithTimestampResolution(r TsResolution) WriterOption {
+	return func(w *Writer) { w.resolution = r }
+}
+
+// WithByteOrder selects the byte order a Writer encodes its file and
+// packet headers with.  The default is binary.LittleEndian.
+func WithByteOrder(order binary.ByteOrder) WriterOption {
+	return func(w *Writer) { w.byteOrder = order }
+}
+
 // NewWriter returns a new writer object, for writing packet data out
 // to the given writer.  If this is a new empty writer (as opposed to
 // an append), you must call WriteFileHeader before WritePacket.
 //
-//  // Write a new file:
-//  f, _ := os.Create("/tmp/file.pcap")
-//  w := pcaputil.NewWriter(f)
-//  w.WriteFileHeader(65536, layers.LinkTypeEthernet)  // new file, must do this.
-//  w.WritePacket(gopacket.CaptureInfo{...}, data1)
-//  f.Close()
-//  // Append to existing file (must have same snaplen and linktype)
-//  f2, _ := os.OpenFile("/tmp/file.pcap", os.O_APPEND, 0700)
-//  w2 := pcaputil.NewWriter(f2)
-//  // no need for file header, it's already written.
-//  w2.WritePacket(gopacket.CaptureInfo{...}, data2)
-//  f2.Close()
-func NewWriter(w io.Writer) *Writer {
-	return &Writer{w: w}
+//	// Write a new file:
+//	f, _ := os.Create("/tmp/file.pcap")
+//	w := pcaputil.NewWriter(f)
+//	w.WriteFileHeader(65536, layers.LinkTypeEthernet)  // new file, must do this.
+//	w.WritePacket(gopacket.CaptureInfo{...}, data1)
+//	w.Flush()
+//	f.Close()
+//	// Append to existing file (must have same snaplen and linktype)
+//	f2, _ := os.OpenFile("/tmp/file.pcap", os.O_APPEND, 0700)
+//	w2 := pcaputil.NewWriter(f2)
+//	// no need for file header, it's already written.
+//	w2.WritePacket(gopacket.CaptureInfo{...}, data2)
+//	w2.Flush()
+//	f2.Close()
+func NewWriter(w io.Writer, opts ...WriterOption) *Writer {
+	return NewWriterSize(w, defaultBufSize, opts...)
+}
+
+// NewWriterSize is like NewWriter, but uses a buffer of the given size
+// instead of the default buffer size.
+func NewWriterSize(w io.Writer, bufSize int, opts ...WriterOption) *Writer {
+	writer := &Writer{
+		buf:        bufio.NewWriterSize(w, bufSize),
+		w:          w,
+		byteOrder:  binary.LittleEndian,
+		resolution: TsResolutionNano,
+	}
+	for _, opt := range opts {
+		opt(writer)
+	}
+	return writer
+}
+
+// NewAppendWriter is like NewWriter, but for appending to a file that
+// already has a header written.  existingMagic is the magic number
+// read from the first four bytes of that file's header, decoded with
+// binary.LittleEndian.Uint32; it is used to validate that opts
+// describe the same byte order and timestamp resolution the file was
+// originally written with, returning an error if they don't match
+// rather than silently producing a corrupt file.
+func NewAppendWriter(w io.Writer, existingMagic uint32, opts ...WriterOption) (*Writer, error) {
+	wantOrder, err := DetectByteOrder(existingMagic)
+	if err != nil {
+		return nil, err
+	}
+	wantResolution, err := DetectResolution(existingMagic)
+	if err != nil {
+		return nil, err
+	}
+	writer := NewWriter(w, opts...)
+	if writer.byteOrder != wantOrder || writer.resolution != wantResolution {
+		return nil, fmt.Errorf("pcaputil: append configuration mismatch: file is %v/%v, but writer was configured for %v/%v",
+			byteOrderName(wantOrder), wantResolution, byteOrderName(writer.byteOrder), writer.resolution)
+	}
+	return writer, nil
+}
+
+func byteOrderName(order binary.ByteOrder) string {
+	if order == binary.BigEndian {
+		return "big-endian"
+	}
+	return "little-endian"
+}
+
+// DetectByteOrder returns the byte order a PCAP file was written in,
+// given its magic number decoded with binary.LittleEndian.Uint32 from
+// the first four bytes of its header.
+func DetectByteOrder(magic uint32) (binary.ByteOrder, error) {
+	switch magic {
+	case magicNanoseconds, magicMicroseconds:
+		return binary.LittleEndian, nil
+	case swapUint32(magicNanoseconds), swapUint32(magicMicroseconds):
+		return binary.BigEndian, nil
+	}
+	return nil, fmt.Errorf("unrecognized pcap magic number %#x", magic)
+}
+
+// DetectResolution returns the timestamp resolution a PCAP file was
+// written with, given its magic number decoded with
+// binary.LittleEndian.Uint32 from the first four bytes of its header.
+func DetectResolution(magic uint32) (TsResolution, error) {
+	switch magic {
+	case magicMicroseconds, swapUint32(magicMicroseconds):
+		return TsResolutionMicro, nil
+	case magicNanoseconds, swapUint32(magicNanoseconds):
+		return TsResolutionNano, nil
+	}
+	return 0, fmt.Errorf("unrecognized pcap magic number %#x", magic)
+}
+
+func swapUint32(v uint32) uint32 {
+	return (v << 24) | ((v & 0xFF00) << 8) | ((v & 0xFF0000) >> 8) | (v >> 24)
 }
 
 // WriteFileHeader writes a file header out to the writer.
 // This must be called exactly once per output.
 func (w *Writer) WriteFileHeader(snaplen uint32, linktype layers.LinkType) error {
+	magic := uint32(magicNanoseconds)
+	if w.resolution == TsResolutionMicro {
+		magic = magicMicroseconds
+	}
 	var buf [24]byte
-	binary.LittleEndian.PutUint32(buf[0:4], magicNanoseconds)
-	binary.LittleEndian.PutUint16(buf[4:6], versionMajor)
-	binary.LittleEndian.PutUint16(buf[6:8], versionMinor)
+	w.byteOrder.PutUint32(buf[0:4], magic)
+	w.byteOrder.PutUint16(buf[4:6], versionMajor)
+	w.byteOrder.PutUint16(buf[6:8], versionMinor)
 	// bytes 8:12 stay 0 (timezone = UTC)
 	// bytes 12:16 stay 0 (sigfigs is always set to zero, according to
 	//   http://wiki.wireshark.org/Development/LibpcapFileFormat
-	binary.LittleEndian.PutUint32(buf[16:20], snaplen)
-	binary.LittleEndian.PutUint32(buf[20:24], uint32(linktype))
-	_, err := w.w.Write(buf[:])
+	w.byteOrder.PutUint32(buf[16:20], snaplen)
+	w.byteOrder.PutUint32(buf[20:24], uint32(linktype))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.buf.Write(buf[:])
 	return err
 }
 
 const nanosPerSecond = 1000000000
+const nanosPerMicro = 1000
 
-func (w *Writer) writePacketHeader(ci gopacket.CaptureInfo) error {
-	var buf [16]byte
+func (w *Writer) writePacketHeader(buf []byte, ci gopacket.CaptureInfo) {
 	nanos := ci.Timestamp.UnixNano()
 	secs, nsecs := uint32(nanos/nanosPerSecond), uint32(nanos%nanosPerSecond)
-	binary.LittleEndian.PutUint32(buf[0:4], secs)
-	binary.LittleEndian.PutUint32(buf[4:8], nsecs)
-	binary.LittleEndian.PutUint32(buf[8:12], uint32(ci.CaptureLength))
-	binary.LittleEndian.PutUint32(buf[12:16], uint32(ci.Length))
-	_, err := w.w.Write(buf[:])
-	return err
+	if w.resolution == TsResolutionMicro {
+		nsecs /= nanosPerMicro
+	}
+	w.byteOrder.PutUint32(buf[0:4], secs)
+	w.byteOrder.PutUint32(buf[4:8], nsecs)
+	w.byteOrder.PutUint32(buf[8:12], uint32(ci.CaptureLength))
+	w.byteOrder.PutUint32(buf[12:16], uint32(ci.Length))
 }
 
 // WritePacket writes the given packet data out to the file.
@@ -90,9 +249,42 @@ func (w *Writer) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
 	if ci.CaptureLength > ci.Length {
 		return fmt.Errorf("invalid capture info %+v:  capture length > length", ci)
 	}
-	if err := w.writePacketHeader(ci); err != nil {
-		return fmt.Errorf("error writing packet header: %v", err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	need := 16 + len(data)
+	if cap(w.scratch) < need {
+		w.scratch = make([]byte, need)
+	} else {
+		w.scratch = w.scratch[:need]
 	}
-	_, err := w.w.Write(data)
-	return err
-}
\ No newline at end of file
+	w.writePacketHeader(w.scratch[:16], ci)
+	copy(w.scratch[16:], data)
+	if _, err := w.buf.Write(w.scratch); err != nil {
+		return fmt.Errorf("error writing packet: %v", err)
+	}
+	return nil
+}
+
+// Flush writes any buffered packet data out to the underlying
+// io.Writer.  It must be called before closing the underlying writer,
+// or buffered data will be lost.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Flush()
+}
+
+// Sync flushes any buffered packet data, then, if the underlying
+// io.Writer implements Syncer (as *os.File does), calls Sync on it to
+// commit the data to stable storage.
+func (w *Writer) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if s, ok := w.w.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}